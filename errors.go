@@ -0,0 +1,115 @@
+package restclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxHTTPErrorBody bounds how much of a response body HTTPError captures, so
+// a handler reading an unexpectedly large error page doesn't buffer all of
+// it in memory.
+const maxHTTPErrorBody = 16 << 10
+
+// HTTPError is the concrete error type built by DefaultErrorConstructor for
+// a non-2xx response. It's also a useful type for custom ErrorConstructors
+// to return, so callers can type-assert or errors.As to it regardless of
+// which handler produced the error.
+type HTTPError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Header     http.Header
+	// Body holds up to maxHTTPErrorBody bytes of the response body, for
+	// diagnostics. It is not guaranteed to be the complete body.
+	Body []byte
+}
+
+func (e *HTTPError) Error() string {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(e.Body, &body); err == nil && body.Error != "" {
+		return fmt.Sprintf("%s %s: %s", e.Method, e.URL, body.Error)
+	}
+	if len(e.Body) > 0 {
+		return fmt.Sprintf("%s %s: unexpected status %d: %s", e.Method, e.URL, e.StatusCode, e.Body)
+	}
+	return fmt.Sprintf("%s %s: unexpected status %d", e.Method, e.URL, e.StatusCode)
+}
+
+// StatusMatcher decides whether an ErrorConstructor applies to a response,
+// based on its status code.
+type StatusMatcher func(statusCode int) bool
+
+// StatusIs matches a single, exact status code.
+func StatusIs(code int) StatusMatcher {
+	return func(statusCode int) bool {
+		return statusCode == code
+	}
+}
+
+// StatusRange matches any status code between low and high, inclusive.
+func StatusRange(low, high int) StatusMatcher {
+	return func(statusCode int) bool {
+		return statusCode >= low && statusCode <= high
+	}
+}
+
+// Status4xx matches any client error response.
+var Status4xx = StatusRange(400, 499)
+
+// Status5xx matches any server error response.
+var Status5xx = StatusRange(500, 599)
+
+// ErrorConstructor builds an error from a non-2xx response. It's passed the
+// originating Request alongside the Response, and is responsible for
+// reading (and the caller for closing) the response body.
+type ErrorConstructor func(*http.Request, *http.Response) error
+
+type errorHandler struct {
+	matcher StatusMatcher
+	fn      ErrorConstructor
+}
+
+// RegisterErrorHandler adds an ErrorConstructor that will be used to build
+// the error returned for any response whose status code satisfies matcher.
+// Handlers are consulted in registration order, and the first match wins,
+// so register more specific matchers (e.g. StatusIs(401)) before broader
+// ones (e.g. Status5xx).
+//
+// If no registered handler matches a non-2xx response, DefaultErrorConstructor
+// is used, so Do/DoStream etc. always return a non-nil error for 4xx/5xx
+// responses unless a handler is registered that returns nil.
+func (client *httpClient) RegisterErrorHandler(matcher StatusMatcher, fn ErrorConstructor) {
+	client.errorHandlers = append(client.errorHandlers, errorHandler{matcher, fn})
+}
+
+func (client *httpClient) errorConstructorFor(statusCode int) ErrorConstructor {
+	for _, h := range client.errorHandlers {
+		if h.matcher(statusCode) {
+			return h.fn
+		}
+	}
+	if statusCode < 200 || statusCode >= 300 {
+		return DefaultErrorConstructor
+	}
+	return nil
+}
+
+// DefaultErrorConstructor is used for any non-2xx response with no more
+// specific handler registered via RegisterErrorHandler. It returns an
+// *HTTPError capturing the response's status, headers, and a snippet of its
+// body - the body is tried as {"error": "..."} JSON when rendering the
+// error message, falling back to the raw snippet if it isn't in that shape.
+func DefaultErrorConstructor(req *http.Request, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxHTTPErrorBody))
+	return &HTTPError{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+	}
+}
@@ -0,0 +1,42 @@
+package restclient
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+)
+
+// decompress transparently decodes a gzip-encoded response body in place,
+// so callers never see compressed bytes. requestOnce sets Accept-Encoding:
+// gzip on every outgoing request (unless the caller already set one), which
+// - unlike relying on the Go HTTP transport's own implicit gzip handling -
+// keeps decompression working even when a custom *http.Client/Transport is
+// supplied via WithHTTPClient.
+func decompress(resp *http.Response) error {
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return nil
+	}
+
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = &gzipBody{gz, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	return nil
+}
+
+// gzipBody wraps a gzip.Reader so that closing it also closes the
+// underlying compressed body.
+type gzipBody struct {
+	*gzip.Reader
+	compressed io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	err := b.Reader.Close()
+	if cerr := b.compressed.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package restclient
+
+import (
+	"context"
+	"net/http"
+)
+
+// BeforeFunc is called with the outgoing request before it is sent. It can
+// mutate the request (set headers, sign it, attach tracing) or abort the
+// request entirely by returning a non-nil error, which is returned to the
+// caller of Do/DoStream/DoCtx/DoStreamCtx in place of making the request.
+type BeforeFunc func(ctx context.Context, req *http.Request) error
+
+// HookAbortError wraps the error returned by a BeforeFunc that aborted a
+// request. The retry layer never reached the network for an aborted
+// request, so it's not a transport failure: DefaultCheckRetry treats a
+// HookAbortError as non-retryable, and a custom CheckRetry can use
+// errors.As to make the same distinction.
+type HookAbortError struct {
+	Err error
+}
+
+func (e *HookAbortError) Error() string { return e.Err.Error() }
+
+func (e *HookAbortError) Unwrap() error { return e.Err }
+
+// AfterFunc is called with the response once it's been received, before it's
+// handed back to the caller. It can inspect response headers (rate-limit
+// metadata, ETags, pagination cursors) but must not consume or close the
+// response body.
+type AfterFunc func(ctx context.Context, resp *http.Response)
+
+// AddBeforeFunc registers a BeforeFunc to run before every request made with
+// this client. Hooks run in the order they were registered; the first to
+// return an error aborts the request.
+func (client *httpClient) AddBeforeFunc(fn BeforeFunc) {
+	client.beforeFuncs = append(client.beforeFuncs, fn)
+}
+
+// AddAfterFunc registers an AfterFunc to run after every request made with
+// this client that receives a response. Hooks run in the order they were
+// registered.
+func (client *httpClient) AddAfterFunc(fn AfterFunc) {
+	client.afterFuncs = append(client.afterFuncs, fn)
+}
+
+func (client *httpClient) runBeforeFuncs(ctx context.Context, req *http.Request) error {
+	for _, fn := range client.beforeFuncs {
+		if err := fn(ctx, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (client *httpClient) runAfterFuncs(ctx context.Context, resp *http.Response) {
+	for _, fn := range client.afterFuncs {
+		fn(ctx, resp)
+	}
+}
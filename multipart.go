@@ -0,0 +1,103 @@
+package restclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+)
+
+// FileUpload describes a single file part of a multipart/form-data request
+// built by DoMultipart or DoMultipartStream. Content is streamed directly
+// into the request body, so it does not need to fit in memory.
+type FileUpload struct {
+	FieldName   string
+	FileName    string
+	ContentType string
+	Content     io.Reader
+}
+
+func (client *httpClient) requestMultipart(ctx context.Context, method, path string, fields map[string]string, files []FileUpload, opts ...RequestOption) (int, io.ReadCloser, http.Header, error) {
+	body, contentType := multipartBody(fields, files)
+	cfg := parseRequestConfig(opts...)
+	if cfg.header.Get("Content-Type") == "" {
+		opts = append([]RequestOption{WithHeader("Content-Type", contentType)}, opts...)
+	}
+	return client.requestRaw(ctx, method, path, body, opts...)
+}
+
+// multipartBody returns a reader that streams a multipart/form-data body as
+// it's read, along with the Content-Type header (including boundary) to
+// send it with. The fields and files are written in a goroutine through an
+// io.Pipe, so the whole payload is never buffered in memory.
+func multipartBody(fields map[string]string, files []FileUpload) (io.Reader, string) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	go func() {
+		pw.CloseWithError(writeMultipart(mw, fields, files))
+	}()
+
+	return pr, mw.FormDataContentType()
+}
+
+func writeMultipart(mw *multipart.Writer, fields map[string]string, files []FileUpload) error {
+	for name, value := range fields {
+		if err := mw.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range files {
+		part, err := multipartFilePart(mw, f)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, f.Content); err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+func multipartFilePart(mw *multipart.Writer, f FileUpload) (io.Writer, error) {
+	if f.ContentType == "" {
+		return mw.CreateFormFile(f.FieldName, f.FileName)
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, f.FieldName, f.FileName))
+	header.Set("Content-Type", f.ContentType)
+	return mw.CreatePart(header)
+}
+
+func (client *httpClient) DoMultipart(method, path string, fields map[string]string, files []FileUpload, into interface{}) (int, error) {
+	return client.DoMultipartCtx(context.Background(), method, path, fields, files, into)
+}
+
+func (client *httpClient) DoMultipartCtx(ctx context.Context, method, path string, fields map[string]string, files []FileUpload, into interface{}, opts ...RequestOption) (int, error) {
+	status, body, header, err := client.requestMultipart(ctx, method, path, fields, files, opts...)
+	if err != nil {
+		return status, err
+	}
+	defer body.Close()
+
+	if into == nil {
+		return status, nil
+	}
+
+	cfg := parseRequestConfig(opts...)
+	return status, client.decodeCodecFor(cfg, header.Get("Content-Type")).Decode(body, into)
+}
+
+func (client *httpClient) DoMultipartStream(method, path string, fields map[string]string, files []FileUpload) (int, io.ReadCloser, error) {
+	return client.DoMultipartStreamCtx(context.Background(), method, path, fields, files)
+}
+
+func (client *httpClient) DoMultipartStreamCtx(ctx context.Context, method, path string, fields map[string]string, files []FileUpload, opts ...RequestOption) (int, io.ReadCloser, error) {
+	status, body, _, err := client.requestMultipart(ctx, method, path, fields, files, opts...)
+	return status, body, err
+}
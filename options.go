@@ -0,0 +1,71 @@
+package restclient
+
+import (
+	"net/http"
+	"time"
+)
+
+// Option configures a Client at construction time, via New.
+type Option func(*httpClient)
+
+// WithHTTPClient sets the *http.Client used to perform requests. If this
+// option is not supplied, New allocates a single *http.Client that is shared
+// by all requests made through the Client, so connections are pooled and
+// reused rather than a fresh client (and fresh connection) being created for
+// every call.
+//
+// This is useful for supplying a client with custom transport settings (TLS
+// config, proxies, connection limits) or a fake client for testing.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *httpClient) {
+		c.httpClient = hc
+	}
+}
+
+// RequestOption customizes a single request made via one of the Ctx methods
+// (DoCtx, DoStreamCtx, DoMultipartCtx, DoMultipartStreamCtx, DoResponseCtx).
+type RequestOption func(*requestConfig)
+
+type requestConfig struct {
+	timeout time.Duration
+	header  http.Header
+	codec   Codec
+}
+
+// WithTimeout bounds each attempt of a single request to the given duration,
+// on top of any deadline already present on the context passed in. When the
+// RetryPolicy retries, every attempt gets its own timeout; the request as a
+// whole, including backoff between attempts, is not bounded by it.
+func WithTimeout(d time.Duration) RequestOption {
+	return func(cfg *requestConfig) {
+		cfg.timeout = d
+	}
+}
+
+// WithHeader adds a header to a single request. It may be passed more than
+// once to set multiple headers.
+func WithHeader(key, value string) RequestOption {
+	return func(cfg *requestConfig) {
+		if cfg.header == nil {
+			cfg.header = make(http.Header)
+		}
+		cfg.header.Add(key, value)
+	}
+}
+
+// WithCodec overrides the Codec used to encode this request's payload and
+// decode its response, regardless of the client's default codec or any
+// codec registered via RegisterCodec.
+func WithCodec(codec Codec) RequestOption {
+	return func(cfg *requestConfig) {
+		cfg.codec = codec
+	}
+}
+
+func parseRequestConfig(opts ...RequestOption) requestConfig {
+	var cfg requestConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
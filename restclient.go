@@ -1,14 +1,15 @@
 // Package restclient provides a simple client for talking to RESTful HTTP
 // APIs that mostly return JSON responses.
 //
-//
 // For handling response bodies, it supports either streams or automatically
-// encoding & decoding of JSON.
+// encoding & decoding payloads with a Codec - JSON by default, with XML and
+// gob also built in, and further formats pluggable via SetCodec.
 package restclient
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"io"
 	"net/http"
 	"strconv"
@@ -27,37 +28,117 @@ type Client interface {
 	//
 	// If the payload satisfies io.Reader, it will be streamed in the request body.
 	//
-	// Otherwise, it will be encoded as JSON. If JSON encoding fails, an error
-	// is returned with no request sent.
+	// Otherwise, it will be encoded with the client's Codec (JSON by
+	// default, see SetCodec). If encoding fails, an error is returned with
+	// no request sent.
 	//
-	// The response is assumed to be JSON and is parsed into the final argument.
+	// The response is decoded into the final argument with the same Codec,
+	// or whichever Codec matches its Content-Type if one was registered via
+	// RegisterCodec.
 	Do(method string, path string, payload, into interface{}) (int, error)
 
-	// Similar behaviour to Do(), but the response is not assumed to be JSON.
-	// Instead it's returned as a stream.
+	// Similar behaviour to Do(), but the response is not decoded with a
+	// Codec. Instead it's returned as a stream.
 	//
 	// The caller must call Close() on the response when it's finished with it.
 	DoStream(method string, path string, payload interface{}) (int, io.ReadCloser, error)
 
-	// Set an error constructor that will be used when processing any response
-	// with a status code in the list of specified status codes.
-	//
-	// If this method is not used, 4xx and 5xx responses do not produce an error.
-	//
-	// This can be used to set a constructor that will be called if the status
-	// code is in the specified set. The set can include any status code.
-	//
-	// The function is passed the Request and Response.
-	//
-	// Each call to SetErrorConstructor() overrides the effect of any previous
-	// calls - it is not possible to set different handlers for different sets
-	// of response status codes.
-	SetErrorConstructor([]int, func(*http.Request, *http.Response) error)
+	// Similar behaviour to Do(), but the request is built with the given
+	// context, so it can be cancelled, given a deadline, or carry
+	// request-scoped values. Any RequestOption is applied to this request
+	// only.
+	DoCtx(ctx context.Context, method string, path string, payload, into interface{}, opts ...RequestOption) (int, error)
+
+	// Similar behaviour to DoStream(), but the request is built with the
+	// given context, so it can be cancelled, given a deadline, or carry
+	// request-scoped values. Any RequestOption is applied to this request
+	// only.
+	DoStreamCtx(ctx context.Context, method string, path string, payload interface{}, opts ...RequestOption) (int, io.ReadCloser, error)
+
+	// DoMultipart sends a multipart/form-data request built from fields and
+	// files, streaming file contents into the request body without
+	// buffering the whole payload in memory. The response is decoded into
+	// into with the client's Codec, as with Do.
+	DoMultipart(method string, path string, fields map[string]string, files []FileUpload, into interface{}) (int, error)
+
+	// DoMultipartCtx is like DoMultipart, but the request is built with the
+	// given context and accepts RequestOptions, as with DoCtx.
+	DoMultipartCtx(ctx context.Context, method string, path string, fields map[string]string, files []FileUpload, into interface{}, opts ...RequestOption) (int, error)
+
+	// DoMultipartStream is like DoMultipart, but the response is returned
+	// as a stream rather than decoded with a Codec, as with DoStream.
+	DoMultipartStream(method string, path string, fields map[string]string, files []FileUpload) (int, io.ReadCloser, error)
+
+	// DoMultipartStreamCtx is like DoMultipartStream, but the request is
+	// built with the given context and accepts RequestOptions, as with
+	// DoStreamCtx.
+	DoMultipartStreamCtx(ctx context.Context, method string, path string, fields map[string]string, files []FileUpload, opts ...RequestOption) (int, io.ReadCloser, error)
+
+	// RegisterErrorHandler adds an ErrorConstructor used to build the error
+	// returned for responses whose status code matches matcher. See its doc
+	// comment for how matchers and ordering interact, and note that - unlike
+	// the single-override API this replaced - 4xx/5xx responses produce an
+	// error by default (via DefaultErrorConstructor) even with no handlers
+	// registered.
+	RegisterErrorHandler(matcher StatusMatcher, fn ErrorConstructor)
+
+	// AddBeforeFunc registers a hook that runs before every request is sent,
+	// e.g. to attach auth headers or sign the request. Hooks run in
+	// registration order; one returning an error aborts the request.
+	AddBeforeFunc(BeforeFunc)
+
+	// AddAfterFunc registers a hook that runs after every response is
+	// received, e.g. to read rate-limit headers or propagate trace info.
+	// Hooks run in registration order.
+	AddAfterFunc(AfterFunc)
+
+	// SetRetryPolicy sets the policy used to decide whether a failed request
+	// is retried. The zero value RetryPolicy (and the default policy used by
+	// New) never retries; pass DefaultRetryPolicy for sensible retry
+	// behaviour, or a custom RetryPolicy for full control.
+	SetRetryPolicy(RetryPolicy)
+
+	// SetCodec sets the Codec used by default to encode request payloads
+	// and decode response bodies, in place of the default JSONCodec. A
+	// single request can use a different codec via WithCodec.
+	SetCodec(Codec)
+
+	// RegisterCodec registers a Codec to decode responses whose
+	// Content-Type header matches contentType, regardless of the client's
+	// default codec.
+	RegisterCodec(contentType string, codec Codec)
+
+	// DoResponse is like Do, but also returns a *Response giving access to
+	// the status code, headers, and raw body alongside the decoded value.
+	DoResponse(method string, path string, payload, into interface{}) (*Response, error)
+
+	// DoResponseCtx is like DoResponse, but the request is built with the
+	// given context and accepts RequestOptions, as with DoCtx.
+	DoResponseCtx(ctx context.Context, method string, path string, payload, into interface{}, opts ...RequestOption) (*Response, error)
+}
+
+// Response holds the status, headers, and raw body of a response, returned
+// by DoResponse/DoResponseCtx alongside the value decoded into into.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
 }
 
 // New creates a new HTTP client.
-func New(host string, port int, useHTTPS bool) Client {
-	return &httpClient{host, port, useHTTPS, nil, nil}
+func New(host string, port int, useHTTPS bool, opts ...Option) Client {
+	client := &httpClient{
+		host:       host,
+		port:       port,
+		useHTTPS:   useHTTPS,
+		httpClient: &http.Client{},
+	}
+
+	for _, opt := range opts {
+		opt(client)
+	}
+
+	return client
 }
 
 // HTTPClient implementation.
@@ -66,8 +147,22 @@ type httpClient struct {
 	port     int
 	useHTTPS bool
 
-	customErrorStatusCodes []int
-	customErrorConstructor func(*http.Request, *http.Response) error
+	// httpClient performs the actual requests. It defaults to a single
+	// shared *http.Client so connections are pooled across requests, but can
+	// be overridden with WithHTTPClient.
+	httpClient *http.Client
+
+	errorHandlers []errorHandler
+
+	beforeFuncs []BeforeFunc
+	afterFuncs  []AfterFunc
+
+	retryPolicy RetryPolicy
+
+	// codec is the default Codec used to encode request payloads and
+	// decode response bodies. It defaults to JSONCodec{} (see defaultCodec).
+	codec               Codec
+	codecsByContentType map[string]Codec
 }
 
 func (client *httpClient) fullPath(path string) string {
@@ -92,44 +187,159 @@ func (client *httpClient) fullPath(path string) string {
 	return proto + "://" + client.host + port + path
 }
 
-func (client *httpClient) requestRaw(method string, path string, payload io.Reader) (int, io.ReadCloser, error) {
+// requestOnce builds and sends a single attempt of the request, running the
+// before/after hooks around it. The returned cancel func releases resources
+// tied to cfg.timeout (if any) and must be called once the caller is done
+// with resp.
+func (client *httpClient) requestOnce(ctx context.Context, method, path string, body io.Reader, cfg requestConfig) (*http.Request, *http.Response, context.CancelFunc, error) {
+	cancel := context.CancelFunc(func() {})
+	if cfg.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cfg.timeout)
+	}
+
 	fullPath := client.fullPath(path)
 
-	var req *http.Request
-	var err error
+	req, err := http.NewRequestWithContext(ctx, method, fullPath, body)
+	if err != nil {
+		cancel()
+		return nil, nil, noopCancel, err
+	}
+	for key, values := range cfg.header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
 
-	req, err = http.NewRequest(method, fullPath, payload)
+	if err := client.runBeforeFuncs(ctx, req); err != nil {
+		// The request is never sent, so nothing else will read req.Body to
+		// EOF - for a streamed body (e.g. multipartBody's io.Pipe) that
+		// would otherwise leave the writing goroutine blocked forever.
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		cancel()
+		return req, nil, noopCancel, &HookAbortError{Err: err}
+	}
 
+	resp, err := client.httpClient.Do(req)
 	if err != nil {
-		return -1, nil, err
+		cancel()
+		return req, nil, noopCancel, err
 	}
 
-	resp, err := (&http.Client{}).Do(req)
+	if err := decompress(resp); err != nil {
+		resp.Body.Close()
+		cancel()
+		return req, nil, noopCancel, err
+	}
 
-	if err != nil {
-		return -1, nil, err
-	} else if client.hasCustomError(resp.StatusCode) {
-		return resp.StatusCode, nil, client.customErrorResponse(req, resp)
+	client.runAfterFuncs(ctx, resp)
+
+	return req, resp, cancel, nil
+}
+
+// requestRaw sends a request and returns its status, body, and response
+// headers (used by requestJSON to pick a decode Codec, and by DoResponseCtx
+// to give callers full access to them), along with any error.
+func (client *httpClient) requestRaw(ctx context.Context, method string, path string, payload io.Reader, opts ...RequestOption) (int, io.ReadCloser, http.Header, error) {
+	cfg := parseRequestConfig(opts...)
+
+	getBody, retryable := rewindable(payload)
+
+	policy := client.retryPolicy
+	maxAttempts := policy.maxAttempts()
+	if !retryable {
+		maxAttempts = 1
 	}
+	checkRetry := policy.checkRetryFunc()
 
-	return resp.StatusCode, resp.Body, err
+	var lastErr error
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		body := payload
+		if getBody != nil {
+			body = getBody()
+		}
+
+		req, resp, cancel, err := client.requestOnce(ctx, method, path, body, cfg)
+
+		shouldRetry, checkErr := checkRetry(resp, err)
+		if checkErr != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			cancel()
+			return statusOrUnknown(resp), nil, nil, checkErr
+		}
+
+		if shouldRetry && attempt < maxAttempts {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			cancel()
+			lastErr = err
+			wait, ok := retryAfter(resp)
+			if !ok {
+				wait = policy.backoff(attempt - 1)
+			}
+			sleepCtx(ctx, wait)
+			continue
+		}
+
+		if err != nil {
+			cancel()
+			var abortErr *HookAbortError
+			if errors.As(err, &abortErr) {
+				err = abortErr.Err
+			}
+			return -1, nil, nil, err
+		}
+
+		if fn := client.errorConstructorFor(resp.StatusCode); fn != nil {
+			if err := fn(req, resp); err != nil {
+				cancel()
+				resp.Body.Close()
+				return resp.StatusCode, nil, resp.Header, err
+			}
+			// The handler matched but chose to suppress the error (returned
+			// nil), so treat the response like any other successful one -
+			// the body is handed back rather than closed out from under the
+			// caller.
+		}
+
+		return resp.StatusCode, &cancelOnClose{resp.Body, cancel}, resp.Header, nil
+	}
+
+	return -1, nil, nil, lastErr
 }
 
-func (client *httpClient) request(method string, path string, payload interface{}) (int, io.ReadCloser, error) {
+func (client *httpClient) request(ctx context.Context, method string, path string, payload interface{}, opts ...RequestOption) (int, io.ReadCloser, http.Header, error) {
 	rdr, ok := payload.(io.Reader)
 	if !ok {
-		// Payload is not a reader - assume it's JSON and try to encode it
-		enc, err := json.Marshal(payload)
-		if err != nil {
-			return -1, nil, err
+		// Payload is not a reader - encode it with the configured Codec
+		// (JSON by default).
+		cfg := parseRequestConfig(opts...)
+		codec := client.encodeCodecFor(cfg)
+
+		var buf bytes.Buffer
+		if err := codec.Encode(&buf, payload); err != nil {
+			return -1, nil, nil, err
+		}
+		// bytes.Reader is seekable, so the retry layer can replay this body
+		// on a retried attempt.
+		rdr = bytes.NewReader(buf.Bytes())
+		if cfg.header.Get("Content-Type") == "" {
+			opts = append([]RequestOption{WithHeader("Content-Type", codec.ContentType())}, opts...)
 		}
-		rdr = bytes.NewBuffer(enc)
 	}
-	return client.requestRaw(method, path, rdr)
+	return client.requestRaw(ctx, method, path, rdr, opts...)
 }
 
-func (client *httpClient) requestJSON(method, path string, payload interface{}, into interface{}) (int, error) {
-	status, body, err := client.request(method, path, payload)
+func (client *httpClient) requestJSON(ctx context.Context, method, path string, payload interface{}, into interface{}, opts ...RequestOption) (int, error) {
+	status, body, header, err := client.request(ctx, method, path, payload, opts...)
 
 	if err != nil {
 		return status, err
@@ -137,40 +347,87 @@ func (client *httpClient) requestJSON(method, path string, payload interface{},
 
 	defer body.Close()
 
-	return status, handleJSONResponse(body, into)
+	if into == nil {
+		return status, nil
+	}
+
+	cfg := parseRequestConfig(opts...)
+	return status, client.decodeCodecFor(cfg, header.Get("Content-Type")).Decode(body, into)
 }
 
-func handleJSONResponse(body io.Reader, into interface{}) error {
+func (client *httpClient) requestResponse(ctx context.Context, method, path string, payload interface{}, into interface{}, opts ...RequestOption) (*Response, error) {
+	status, body, header, err := client.request(ctx, method, path, payload, opts...)
+	if err != nil {
+		return &Response{StatusCode: status, Header: header}, err
+	}
+	defer body.Close()
+
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return &Response{StatusCode: status, Header: header}, err
+	}
+	resp := &Response{StatusCode: status, Header: header, Body: raw}
+
 	if into == nil {
-		return nil
+		return resp, nil
 	}
-	dec := json.NewDecoder(body)
-	return dec.Decode(into)
+
+	cfg := parseRequestConfig(opts...)
+	return resp, client.decodeCodecFor(cfg, header.Get("Content-Type")).Decode(bytes.NewReader(raw), into)
+}
+
+// cancelOnClose wraps a response body so that a context's cancel func is
+// released once the caller is done reading the body, instead of leaking
+// until the context's own deadline (if any) elapses.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// noopCancel is returned by requestOnce in place of a real context.CancelFunc
+// when no request was actually made (so there's nothing to cancel), keeping
+// it always safe for callers to invoke.
+func noopCancel() {}
+
+func statusOrUnknown(resp *http.Response) int {
+	if resp == nil {
+		return -1
+	}
+	return resp.StatusCode
 }
 
 func (client *httpClient) Do(method, path string, payload interface{}, into interface{}) (int, error) {
-	return client.requestJSON(method, path, payload, into)
+	return client.requestJSON(context.Background(), method, path, payload, into)
 }
 
 func (client *httpClient) DoStream(method, path string, payload interface{}) (int, io.ReadCloser, error) {
-	return client.request(method, path, payload)
+	status, body, _, err := client.request(context.Background(), method, path, payload)
+	return status, body, err
 }
 
-func (client *httpClient) SetErrorConstructor(statusCodes []int, fn func(*http.Request, *http.Response) error) {
-	client.customErrorStatusCodes = statusCodes
-	client.customErrorConstructor = fn
+func (client *httpClient) DoCtx(ctx context.Context, method, path string, payload, into interface{}, opts ...RequestOption) (int, error) {
+	return client.requestJSON(ctx, method, path, payload, into, opts...)
 }
 
-func (client *httpClient) hasCustomError(statusCode int) bool {
-	for _, c := range client.customErrorStatusCodes {
-		if c == statusCode {
-			return true
-		}
-	}
-	return false
+func (client *httpClient) DoStreamCtx(ctx context.Context, method, path string, payload interface{}, opts ...RequestOption) (int, io.ReadCloser, error) {
+	status, body, _, err := client.request(ctx, method, path, payload, opts...)
+	return status, body, err
+}
+
+func (client *httpClient) DoResponse(method, path string, payload, into interface{}) (*Response, error) {
+	return client.requestResponse(context.Background(), method, path, payload, into)
+}
+
+func (client *httpClient) DoResponseCtx(ctx context.Context, method, path string, payload, into interface{}, opts ...RequestOption) (*Response, error) {
+	return client.requestResponse(ctx, method, path, payload, into, opts...)
 }
 
-func (client *httpClient) customErrorResponse(req *http.Request, resp *http.Response) error {
-	defer resp.Body.Close()
-	return client.customErrorConstructor(req, resp)
+func (client *httpClient) SetRetryPolicy(policy RetryPolicy) {
+	client.retryPolicy = policy
 }
@@ -4,11 +4,17 @@ import (
 	"testing"
 
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"runtime"
+	"strings"
+	"time"
 )
 
 func TestHttpClientPath(t *testing.T) {
@@ -44,28 +50,31 @@ func TestHttpClientRequests(t *testing.T) {
 		expect_request  *testRequest
 		expect_response testResponse
 		expect_method   string
+		expect_error    bool
 	}
 
 	cases := []testcase{
 		// GET requests
-		{"/hello", 200, nil, testResponse{"something"}, "GET"},
-		{"/hi", 200, nil, testResponse{"friendship"}, "GET"},
+		{"/hello", 200, nil, testResponse{"something"}, "GET", false},
+		{"/hi", 200, nil, testResponse{"friendship"}, "GET", false},
 
 		// POST requests with and without body
-		{"/aha", 200, &testRequest{"my cool tracks"}, testResponse{"yes well i"}, "POST"},
-		{"/ahaaaa", 200, nil, testResponse{"ah the ah yeah"}, "POST"},
+		{"/aha", 200, &testRequest{"my cool tracks"}, testResponse{"yes well i"}, "POST", false},
+		{"/ahaaaa", 200, nil, testResponse{"ah the ah yeah"}, "POST", false},
 
 		// PUT requests with and without body
-		{"/welb", 200, &testRequest{"well it's me"}, testResponse{"ahh this could truly be the"}, "PUT"},
-		{"/welbababa", 200, nil, testResponse{"look i just don't want"}, "PUT"},
+		{"/welb", 200, &testRequest{"well it's me"}, testResponse{"ahh this could truly be the"}, "PUT", false},
+		{"/welbababa", 200, nil, testResponse{"look i just don't want"}, "PUT", false},
 
 		// DELETE request
-		{"/krenkt", 200, nil, testResponse{"the one and"}, "DELETE"},
+		{"/krenkt", 200, nil, testResponse{"the one and"}, "DELETE", false},
 
 		//
-		// Requests that should fail.
+		// Requests that should fail. 4xx/5xx responses produce an error via
+		// DefaultErrorConstructor unless a more specific handler is
+		// registered.
 		//
-		{"/some_bad", 400, nil, testResponse{}, "GET"},
+		{"/some_bad", 400, nil, testResponse{}, "GET", true},
 	}
 
 	// First loop over the cases once creating all the handlers
@@ -94,9 +103,9 @@ func TestHttpClientRequests(t *testing.T) {
 			case 0:
 				status, err = client.Do(c.expect_method, c.endpoint, c.expect_request, &res)
 			default:
-				b, err := json.Marshal(c.expect_request)
-				if err != nil {
-					t.Errorf("Failed to marshal request: %s", err)
+				b, merr := json.Marshal(c.expect_request)
+				if merr != nil {
+					t.Errorf("Failed to marshal request: %s", merr)
 					t.Fail()
 					continue
 				}
@@ -114,6 +123,15 @@ func TestHttpClientRequests(t *testing.T) {
 				}
 			}
 
+			if c.expect_error {
+				if err == nil {
+					t.Errorf("Expected an error for %s %s, got nil", c.expect_method, c.endpoint)
+				} else if status != c.expect_status {
+					t.Errorf("Did not get status %d for %s %s", c.expect_status, c.expect_method, c.endpoint)
+				}
+				continue
+			}
+
 			if err != nil {
 				t.Errorf("Error in request: %s", err)
 				t.Fail()
@@ -205,18 +223,18 @@ func makeTestHandler(t *testing.T, endpoint, expect_method string, expect_reques
 	}
 }
 
-func TestCustomErrorConstructor(t *testing.T) {
+func TestCustomErrorHandler(t *testing.T) {
 	type constructorTestCase struct {
-		endpoint            string
-		expect_response     testResponse
-		custom_err_statuses []int
-		custom_err_handler  func(*http.Request, *http.Response) error
-		expect_status       int
-		expect_method       string
-		expect_error        string
+		endpoint      string
+		response      testResponse
+		matcher       StatusMatcher
+		handler       ErrorConstructor
+		expect_status int
+		expect_method string
+		expect_error  string
 	}
 	cases := []constructorTestCase{
-		{"/some_cons_bad", testResponse{"hi my friends"}, []int{400}, func(_ *http.Request, resp *http.Response) error {
+		{"/some_cons_bad", testResponse{"hi my friends"}, StatusIs(400), func(_ *http.Request, resp *http.Response) error {
 			var res testResponse
 			dec := json.NewDecoder(resp.Body)
 			err := dec.Decode(&res)
@@ -230,7 +248,7 @@ func TestCustomErrorConstructor(t *testing.T) {
 	// First loop over the cases once creating all the handlers
 	handlers := make(map[string]http.HandlerFunc)
 	for _, c := range cases {
-		handlers[c.endpoint] = makeTestHandler(t, c.endpoint, c.expect_method, nil, c.expect_status, c.expect_response)
+		handlers[c.endpoint] = makeTestHandler(t, c.endpoint, c.expect_method, nil, c.expect_status, c.response)
 	}
 	server, err := startTestServer(handlers)
 	if err != nil {
@@ -242,21 +260,16 @@ func TestCustomErrorConstructor(t *testing.T) {
 	// Now we can create our client and start making requests
 	client := New("localhost", server.port, false)
 	for _, c := range cases {
-		client.SetErrorConstructor(c.custom_err_statuses, c.custom_err_handler)
+		client.RegisterErrorHandler(c.matcher, c.handler)
 
 		var res testResponse
 
 		status, err := client.Do(c.expect_method, c.endpoint, nil, &res)
 
 		if err == nil && c.expect_error != "" {
-			fmt.Println("hi sir")
-			t.Fail()
+			t.Errorf("Expected error %q, got nil", c.expect_error)
 		} else if err != nil && c.expect_error != err.Error() {
-			fmt.Println("hi sir")
-			t.Fail()
-		} else if err != nil && c.expect_error == "" {
-			t.Errorf("Error in request: %s", err)
-			t.Fail()
+			t.Errorf("Expected error %q, got %q", c.expect_error, err.Error())
 		} else if status != c.expect_status {
 			t.Errorf("Did not get status %d for %s %s", c.expect_status, c.expect_method, c.endpoint)
 			t.Fail()
@@ -264,6 +277,769 @@ func TestCustomErrorConstructor(t *testing.T) {
 	}
 }
 
+func TestDefaultErrorConstructor(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"/unhandled": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(map[string]string{"error": "no such thing"})
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+
+	var res testResponse
+	status, err := client.Do("GET", "/unhandled", nil, &res)
+	if status != 404 {
+		t.Errorf("Expected status 404, got %d", status)
+	}
+	if err == nil {
+		t.Fatalf("Expected an error from the default error constructor, got nil")
+	}
+	if !strings.Contains(err.Error(), "no such thing") {
+		t.Errorf("Expected error to mention %q, got %q", "no such thing", err.Error())
+	}
+}
+
+func TestErrorHandlerReturningNilSuppressesError(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"/soft_fail": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(testResponse{"degraded but usable"})
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+	client.RegisterErrorHandler(StatusIs(500), func(*http.Request, *http.Response) error {
+		return nil
+	})
+
+	var res testResponse
+	status, err := client.Do("GET", "/soft_fail", nil, &res)
+	if err != nil {
+		t.Errorf("Expected a handler returning nil to suppress the error, got %s", err)
+	}
+	if status != 500 {
+		t.Errorf("Expected status 500, got %d", status)
+	}
+	if res.Response != "degraded but usable" {
+		t.Errorf("Expected the body to still be decoded into the caller's value, got %#v", res)
+	}
+}
+
 func TestStreamRequest(t *testing.T) {
 
 }
+
+func TestHttpClientDoCtxCancelled(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"/slow": func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var res testResponse
+	_, err = client.DoCtx(ctx, "GET", "/slow", nil, &res)
+	if err == nil {
+		t.Errorf("Expected an error from a cancelled context, got nil")
+	}
+}
+
+func TestHttpClientDoCtxHeader(t *testing.T) {
+	const headerName = "X-Test-Header"
+	const headerValue = "hello"
+
+	handlers := map[string]http.HandlerFunc{
+		"/header": func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header.Get(headerName); got != headerValue {
+				t.Errorf("Expected header %s to be %q, got %q", headerName, headerValue, got)
+				t.Fail()
+			}
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(testResponse{"ok"})
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+
+	var res testResponse
+	_, err = client.DoCtx(context.Background(), "GET", "/header", nil, &res, WithHeader(headerName, headerValue))
+	if err != nil {
+		t.Errorf("Error in request: %s", err)
+	}
+}
+
+func TestHttpClientCustomContentTypeOverridesCodec(t *testing.T) {
+	const customContentType = "application/vnd.api+json"
+
+	handlers := map[string]http.HandlerFunc{
+		"/custom_ct": func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header["Content-Type"]; len(got) != 1 || got[0] != customContentType {
+				t.Errorf("Expected a single Content-Type header %q, got %v", customContentType, got)
+			}
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(testResponse{"ok"})
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+
+	var res testResponse
+	_, err = client.DoCtx(context.Background(), "POST", "/custom_ct", testRequest{"hi"}, &res, WithHeader("Content-Type", customContentType))
+	if err != nil {
+		t.Errorf("Error in request: %s", err)
+	}
+}
+
+func TestHttpClientDoMultipartCustomContentTypeOverridesBoundary(t *testing.T) {
+	const customContentType = "application/vnd.custom-upload"
+
+	handlers := map[string]http.HandlerFunc{
+		"/custom_ct_upload": func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header["Content-Type"]; len(got) != 1 || got[0] != customContentType {
+				t.Errorf("Expected a single Content-Type header %q, got %v", customContentType, got)
+			}
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(testResponse{"ok"})
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+
+	var res testResponse
+	_, err = client.DoMultipartCtx(context.Background(), "POST", "/custom_ct_upload", nil, nil, &res, WithHeader("Content-Type", customContentType))
+	if err != nil {
+		t.Errorf("Error in request: %s", err)
+	}
+}
+
+func TestHttpClientBeforeAfterFuncs(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"/hooked": func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header.Get("Authorization"); got != "Bearer shh" {
+				t.Errorf("Expected before hook to set Authorization header, got %q", got)
+			}
+			w.Header().Set("X-Rate-Limit-Remaining", "99")
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(testResponse{"ok"})
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+
+	var order []string
+	client.AddBeforeFunc(func(_ context.Context, req *http.Request) error {
+		order = append(order, "before1")
+		req.Header.Set("Authorization", "Bearer shh")
+		return nil
+	})
+	client.AddBeforeFunc(func(_ context.Context, req *http.Request) error {
+		order = append(order, "before2")
+		return nil
+	})
+
+	var remaining string
+	client.AddAfterFunc(func(_ context.Context, resp *http.Response) {
+		order = append(order, "after1")
+		remaining = resp.Header.Get("X-Rate-Limit-Remaining")
+	})
+
+	var res testResponse
+	_, err = client.Do("GET", "/hooked", nil, &res)
+	if err != nil {
+		t.Errorf("Error in request: %s", err)
+	}
+	if remaining != "99" {
+		t.Errorf("Expected after hook to observe rate limit header, got %q", remaining)
+	}
+
+	expectOrder := []string{"before1", "before2", "after1"}
+	if len(order) != len(expectOrder) {
+		t.Fatalf("Expected hook order %v, got %v", expectOrder, order)
+	}
+	for i, name := range expectOrder {
+		if order[i] != name {
+			t.Errorf("Expected hook order %v, got %v", expectOrder, order)
+			break
+		}
+	}
+}
+
+func TestHttpClientRetryPolicy(t *testing.T) {
+	var calls int
+	handlers := map[string]http.HandlerFunc{
+		"/flaky": func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls < 3 {
+				w.WriteHeader(503)
+				return
+			}
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(testResponse{"steady now"})
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+
+	var res testResponse
+	status, err := client.Do("GET", "/flaky", nil, &res)
+	if err != nil {
+		t.Errorf("Error in request: %s", err)
+	}
+	if status != 200 {
+		t.Errorf("Expected eventual success, got status %d", status)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", calls)
+	}
+}
+
+func TestHttpClientNoRetry(t *testing.T) {
+	var calls int
+	handlers := map[string]http.HandlerFunc{
+		"/alwaysdown": func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(503)
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+	client.SetRetryPolicy(NoRetry)
+
+	var res testResponse
+	client.Do("GET", "/alwaysdown", nil, &res)
+	if calls != 1 {
+		t.Errorf("Expected NoRetry to result in a single attempt, got %d", calls)
+	}
+}
+
+func TestHttpClientRetryAfterSeconds(t *testing.T) {
+	var calls int
+	handlers := map[string]http.HandlerFunc{
+		"/throttled": func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls < 2 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(429)
+				return
+			}
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(testResponse{"steady now"})
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+	// A BaseDelay this large would make the wait obviously longer than the
+	// Retry-After value if it weren't honoured.
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, BaseDelay: 5 * time.Second})
+
+	start := time.Now()
+	var res testResponse
+	status, err := client.Do("GET", "/throttled", nil, &res)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Errorf("Error in request: %s", err)
+	}
+	if status != 200 {
+		t.Errorf("Expected eventual success, got status %d", status)
+	}
+	if elapsed < time.Second || elapsed > 3*time.Second {
+		t.Errorf("Expected the retry to wait ~1s per Retry-After, took %s", elapsed)
+	}
+}
+
+func TestHttpClientRetryAfterHTTPDate(t *testing.T) {
+	var calls int
+	handlers := map[string]http.HandlerFunc{
+		"/throttled": func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls < 2 {
+				w.Header().Set("Retry-After", time.Now().Add(2*time.Second).UTC().Format(http.TimeFormat))
+				w.WriteHeader(503)
+				return
+			}
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(testResponse{"steady now"})
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, BaseDelay: 5 * time.Second})
+
+	start := time.Now()
+	var res testResponse
+	status, err := client.Do("GET", "/throttled", nil, &res)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Errorf("Error in request: %s", err)
+	}
+	if status != 200 {
+		t.Errorf("Expected eventual success, got status %d", status)
+	}
+	if elapsed < time.Second || elapsed > 4*time.Second {
+		t.Errorf("Expected the retry to wait ~2s per the Retry-After HTTP-date, took %s", elapsed)
+	}
+}
+
+// nonSeekableReader hides any Seek method a wrapped reader might have, so it
+// looks like a genuine streaming body (e.g. an upload read once from disk or
+// a network socket) to the retry layer's rewindable check.
+type nonSeekableReader struct {
+	r io.Reader
+}
+
+func (n *nonSeekableReader) Read(p []byte) (int, error) {
+	return n.r.Read(p)
+}
+
+func TestHttpClientNonSeekableBodyNotRetried(t *testing.T) {
+	var calls int
+	handlers := map[string]http.HandlerFunc{
+		"/alwaysdown": func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(503)
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+
+	_, _, err = client.DoStreamCtx(context.Background(), "POST", "/alwaysdown", &nonSeekableReader{strings.NewReader("streamed body")})
+	if err == nil {
+		t.Errorf("Expected an error from the always-503 handler")
+	}
+	if calls != 1 {
+		t.Errorf("Expected a non-seekable body to be attempted once regardless of RetryPolicy, got %d calls", calls)
+	}
+}
+
+func TestHttpClientBeforeFuncAbortNotRetried(t *testing.T) {
+	var hookCalls int
+	client := New("localhost", 0, false)
+	client.AddBeforeFunc(func(_ context.Context, _ *http.Request) error {
+		hookCalls++
+		return fmt.Errorf("denied")
+	})
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 4, BaseDelay: 5 * time.Second})
+
+	start := time.Now()
+	var res testResponse
+	_, err := client.Do("GET", "/never", nil, &res)
+	elapsed := time.Since(start)
+	if err == nil || err.Error() != "denied" {
+		t.Errorf("Expected the before hook error to be returned unwrapped, got %v", err)
+	}
+	if hookCalls != 1 {
+		t.Errorf("Expected a hook abort to fail fast without retrying, got %d hook calls", hookCalls)
+	}
+	if elapsed > time.Second {
+		t.Errorf("Expected a hook abort not to incur retry backoff, took %s", elapsed)
+	}
+}
+
+func TestHttpClientCancelledContextNotRetried(t *testing.T) {
+	var checkRetryCalls int
+	client := New("localhost", 0, false)
+	client.SetRetryPolicy(RetryPolicy{
+		MaxAttempts: 4,
+		BaseDelay:   5 * time.Second,
+		CheckRetry: func(resp *http.Response, err error) (bool, error) {
+			checkRetryCalls++
+			return DefaultCheckRetry(resp, err)
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	var res testResponse
+	_, err := client.DoCtx(ctx, "GET", "/never", nil, &res)
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Fatal("Expected an error from an already-cancelled context")
+	}
+	if checkRetryCalls != 1 {
+		t.Errorf("Expected a dead context to fail fast without retrying, got %d CheckRetry calls", checkRetryCalls)
+	}
+	if elapsed > time.Second {
+		t.Errorf("Expected a dead context not to incur retry backoff, took %s", elapsed)
+	}
+}
+
+func TestHttpClientDoMultipart(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"/upload": func(w http.ResponseWriter, r *http.Request) {
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Errorf("Failed to parse multipart form: %s", err)
+				t.Fail()
+				return
+			}
+			if got := r.FormValue("title"); got != "a cool photo" {
+				t.Errorf("Expected field %q, got %q", "a cool photo", got)
+			}
+			file, header, err := r.FormFile("photo")
+			if err != nil {
+				t.Errorf("Expected a file part: %s", err)
+				t.Fail()
+				return
+			}
+			defer file.Close()
+			if header.Filename != "photo.txt" {
+				t.Errorf("Expected filename %q, got %q", "photo.txt", header.Filename)
+			}
+			content, err := io.ReadAll(file)
+			if err != nil {
+				t.Errorf("Failed to read uploaded file: %s", err)
+			}
+			if string(content) != "hello from a file" {
+				t.Errorf("Expected file content %q, got %q", "hello from a file", string(content))
+			}
+
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(testResponse{"uploaded"})
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+
+	fields := map[string]string{"title": "a cool photo"}
+	files := []FileUpload{
+		{FieldName: "photo", FileName: "photo.txt", Content: strings.NewReader("hello from a file")},
+	}
+
+	var res testResponse
+	status, err := client.DoMultipart("POST", "/upload", fields, files, &res)
+	if err != nil {
+		t.Errorf("Error in request: %s", err)
+	}
+	if status != 200 {
+		t.Errorf("Expected status 200, got %d", status)
+	}
+	if res.Response != "uploaded" {
+		t.Errorf("Did not get expected response: %#v", res)
+	}
+}
+
+func TestHttpClientDoMultipartAbortedByBeforeFunc(t *testing.T) {
+	client := New("localhost", 0, false)
+	client.AddBeforeFunc(func(_ context.Context, _ *http.Request) error {
+		return fmt.Errorf("denied")
+	})
+
+	before := runtime.NumGoroutine()
+
+	fields := map[string]string{"title": "a cool photo"}
+	files := []FileUpload{
+		{FieldName: "photo", FileName: "photo.txt", Content: strings.NewReader("hello from a file")},
+	}
+
+	if _, err := client.DoMultipart("POST", "/upload", fields, files, nil); err == nil {
+		t.Fatal("Expected the before hook's error to abort the request")
+	}
+
+	// Nothing reads req.Body (== the multipart pipe reader) when a before
+	// hook aborts, so the goroutine writing into it only exits once the pipe
+	// is closed out from under it. Poll briefly rather than asserting on the
+	// very next instant.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("multipart writer goroutine leaked: goroutine count went from %d to %d", before, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHttpClientXMLCodec(t *testing.T) {
+	type xmlPayload struct {
+		XMLName xml.Name `xml:"payload"`
+		Value   string   `xml:"value"`
+	}
+
+	handlers := map[string]http.HandlerFunc{
+		"/xml": func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header.Get("Content-Type"); got != "application/xml" {
+				t.Errorf("Expected Content-Type %q, got %q", "application/xml", got)
+			}
+			var req xmlPayload
+			if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Errorf("Failed to decode XML request: %s", err)
+			}
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(200)
+			xml.NewEncoder(w).Encode(xmlPayload{Value: req.Value + " echoed"})
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+	client.SetCodec(XMLCodec{})
+
+	var res xmlPayload
+	status, err := client.Do("POST", "/xml", xmlPayload{Value: "hi"}, &res)
+	if err != nil {
+		t.Errorf("Error in request: %s", err)
+	}
+	if status != 200 {
+		t.Errorf("Expected status 200, got %d", status)
+	}
+	if res.Value != "hi echoed" {
+		t.Errorf("Expected %q, got %q", "hi echoed", res.Value)
+	}
+}
+
+func TestHttpClientRegisterCodec(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"/mixed": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(200)
+			io.WriteString(w, `<payload><value>from xml</value></payload>`)
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+	client.RegisterCodec("application/xml", XMLCodec{})
+
+	type xmlPayload struct {
+		Value string `xml:"value"`
+	}
+	var res xmlPayload
+	status, err := client.Do("GET", "/mixed", nil, &res)
+	if err != nil {
+		t.Errorf("Error in request: %s", err)
+	}
+	if status != 200 {
+		t.Errorf("Expected status 200, got %d", status)
+	}
+	if res.Value != "from xml" {
+		t.Errorf("Expected the XML codec registered for application/xml to be used, got %q", res.Value)
+	}
+}
+
+func TestHttpClientGzipResponse(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"/gz": func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header.Get("Accept-Encoding"); got != "gzip" {
+				t.Errorf("Expected Accept-Encoding gzip to be set, got %q", got)
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(200)
+			gz := gzip.NewWriter(w)
+			json.NewEncoder(gz).Encode(testResponse{"decompressed"})
+			gz.Close()
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+
+	var res testResponse
+	status, err := client.Do("GET", "/gz", nil, &res)
+	if err != nil {
+		t.Errorf("Error in request: %s", err)
+	}
+	if status != 200 {
+		t.Errorf("Expected status 200, got %d", status)
+	}
+	if res.Response != "decompressed" {
+		t.Errorf("Expected transparently decompressed response, got %#v", res)
+	}
+}
+
+func TestHttpClientBeforeFuncAborts(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"/never": func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("Handler should not have been called")
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+	client.AddBeforeFunc(func(_ context.Context, req *http.Request) error {
+		return fmt.Errorf("nope")
+	})
+
+	var res testResponse
+	_, err = client.Do("GET", "/never", nil, &res)
+	if err == nil || err.Error() != "nope" {
+		t.Errorf("Expected before hook error to abort the request, got %v", err)
+	}
+}
+
+func TestHttpClientDoResponse(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"/resp": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Custom", "hi")
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(testResponse{"hello there"})
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+
+	var res testResponse
+	resp, err := client.DoResponse("GET", "/resp", nil, &res)
+	if err != nil {
+		t.Errorf("Error in request: %s", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-Custom"); got != "hi" {
+		t.Errorf("Expected X-Custom header %q, got %q", "hi", got)
+	}
+	if !strings.Contains(string(resp.Body), "hello there") {
+		t.Errorf("Expected raw body to contain %q, got %q", "hello there", resp.Body)
+	}
+	if res.Response != "hello there" {
+		t.Errorf("Expected decoded response %#v, got %#v", testResponse{"hello there"}, res)
+	}
+}
+
+func TestHttpClientHTTPError(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"/broken": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(map[string]string{"error": "not found mate"})
+		},
+	}
+	server, err := startTestServer(handlers)
+	if err != nil {
+		t.Errorf("Could not start test server: %s", err)
+		t.FailNow()
+	}
+	defer server.Stop()
+
+	client := New("localhost", server.port, false)
+
+	var res testResponse
+	_, err = client.Do("GET", "/broken", nil, &res)
+	if err == nil {
+		t.Fatalf("Expected an error, got nil")
+	}
+
+	httpErr, ok := err.(*HTTPError)
+	if !ok {
+		t.Fatalf("Expected *HTTPError, got %T", err)
+	}
+	if httpErr.StatusCode != 404 {
+		t.Errorf("Expected StatusCode 404, got %d", httpErr.StatusCode)
+	}
+	if httpErr.Method != "GET" {
+		t.Errorf("Expected Method GET, got %q", httpErr.Method)
+	}
+	if !strings.Contains(string(httpErr.Body), "not found mate") {
+		t.Errorf("Expected Body to contain %q, got %q", "not found mate", httpErr.Body)
+	}
+}
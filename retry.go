@@ -0,0 +1,174 @@
+package restclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls whether and how a failed request is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times a request is attempted,
+	// including the first attempt. Values less than 1 are treated as 1,
+	// i.e. no retries.
+	MaxAttempts int
+
+	// BaseDelay is the backoff delay before the first retry. Each
+	// subsequent retry doubles the previous delay, up to MaxDelay.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the delay computed from BaseDelay.
+	MaxDelay time.Duration
+
+	// Jitter, if true, randomizes each computed delay to a value between
+	// zero and the computed delay, so that multiple clients backing off at
+	// once don't retry in lockstep.
+	Jitter bool
+
+	// CheckRetry decides whether a given attempt should be retried. It's
+	// passed the response (nil if the request failed before one was
+	// received) and the error returned by the underlying HTTP round trip.
+	// Returning a non-nil error stops retrying and that error is returned to
+	// the caller in place of err. If CheckRetry is nil, DefaultCheckRetry is
+	// used.
+	CheckRetry func(resp *http.Response, err error) (bool, error)
+}
+
+// NoRetry is a RetryPolicy that disables retries: every request is
+// attempted exactly once. This is also the zero value's behaviour, so it's
+// mainly useful to explicitly opt out after a client-wide policy has
+// already been set.
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+// DefaultRetryPolicy retries connection errors, HTTP 429, and 5xx responses
+// up to 4 times in total, honouring the Retry-After header when present and
+// otherwise backing off exponentially from 200ms up to 5s, with jitter.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    5 * time.Second,
+	Jitter:      true,
+}
+
+// DefaultCheckRetry retries on connection errors (err != nil), HTTP 429, and
+// any 5xx response. A BeforeFunc abort (see HookAbortError) never reached the
+// network, and a cancelled or expired context will only fail the same way
+// again, so neither is treated as a retryable connection error.
+func DefaultCheckRetry(resp *http.Response, err error) (bool, error) {
+	if err != nil {
+		var abortErr *HookAbortError
+		if errors.As(err, &abortErr) {
+			return false, nil
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false, nil
+		}
+		return true, nil
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return true, nil
+	}
+	return false, nil
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+func (p RetryPolicy) checkRetryFunc() func(*http.Response, error) (bool, error) {
+	if p.CheckRetry != nil {
+		return p.CheckRetry
+	}
+	return DefaultCheckRetry
+}
+
+// backoff computes the delay before the attempt'th retry (0-indexed).
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	base := p.BaseDelay
+	if base <= 0 {
+		base = 200 * time.Millisecond
+	}
+	max := p.MaxDelay
+	if max <= 0 {
+		max = base
+	}
+
+	delay := base << uint(attempt)
+	if delay <= 0 || delay > max {
+		delay = max
+	}
+	if p.Jitter {
+		delay = time.Duration(rand.Int63n(int64(delay) + 1))
+	}
+	return delay
+}
+
+// retryAfter parses the Retry-After header, in either its seconds or
+// HTTP-date form, returning the duration to wait before retrying and
+// whether the header was present and valid.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// sleepCtx waits for d, returning early if ctx is cancelled first.
+func sleepCtx(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// seekableReader is satisfied by io.Reader implementations (such as
+// *bytes.Reader and *strings.Reader) that can be rewound to replay a
+// request body on retry.
+type seekableReader interface {
+	io.Reader
+	Seek(offset int64, whence int) (int64, error)
+}
+
+// rewindable returns a function that produces a fresh, unread view of r each
+// time it's called, and whether that was possible. A nil payload is always
+// rewindable (there's nothing to replay). Non-seekable readers - e.g. a
+// streaming upload - are not, and requests using them are sent at most once
+// regardless of the configured RetryPolicy.
+func rewindable(r io.Reader) (func() io.Reader, bool) {
+	if r == nil {
+		return func() io.Reader { return nil }, true
+	}
+	s, ok := r.(seekableReader)
+	if !ok {
+		return nil, false
+	}
+	return func() io.Reader {
+		s.Seek(0, io.SeekStart)
+		return s
+	}, true
+}